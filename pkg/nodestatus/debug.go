@@ -0,0 +1,182 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nodestatus
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// debugAddr is the address to bind the /debug mux on. It is kept off the
+// main status port (see Run) so that pprof and friends aren't reachable
+// wherever /status/ is exposed.
+var debugAddr = flag.String("debug-addr", "", "address to serve /debug endpoints on, separate from the main status port (disabled if empty)")
+
+// NewDebugMux returns an http.Handler exposing pprof, expvar and internal
+// peer/BIRD diagnostics. It is intended to be bound to its own listener via
+// --debug-addr, the way tailscaled separates its debug server from its
+// regular traffic.
+func NewDebugMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/peers", debugPeersHandler)
+	mux.HandleFunc("/debug/bird", debugBIRDHandler)
+	mux.HandleFunc("/debug/stream", debugStreamHandler)
+	return mux
+}
+
+// debugPeersHandler returns the most recently cached peers as JSON.
+func debugPeersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(cachedPeers()); err != nil {
+		log.WithError(err).Error("Failed to encode cached peers")
+	}
+}
+
+// debugBIRDHandler returns the raw, unparsed "show protocols all" output
+// from BIRD for the requested address family ("ipv" query param, default
+// "4"), for manual diagnosis.
+func debugBIRDHandler(w http.ResponseWriter, r *http.Request) {
+	ipv := r.URL.Query().Get("ipv")
+	if ipv != "6" {
+		ipv = "4"
+	}
+
+	raw, err := queryBIRDRaw(ipv, "show protocols all\n")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, raw)
+}
+
+// queryBIRDRaw issues cmd against the BIRD control socket for ipv and
+// returns the unparsed response, up to the terminating "0000" line.
+func queryBIRDRaw(ipv, cmd string) (string, error) {
+	c, err := dialBIRDSocket(ipv)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	if _, err := c.Write([]byte(cmd)); err != nil {
+		return "", fmt.Errorf("unable to write to BIRD socket: %w", err)
+	}
+
+	var out strings.Builder
+	scanner := bufio.NewScanner(c)
+	c.SetReadDeadline(time.Now().Add(birdTimeOut))
+	for scanner.Scan() {
+		line := scanner.Text()
+		out.WriteString(line)
+		out.WriteByte('\n')
+		if strings.HasPrefix(line, "0000") {
+			break
+		}
+		c.SetReadDeadline(time.Now().Add(birdTimeOut))
+	}
+	if err := scanner.Err(); err != nil {
+		return out.String(), err
+	}
+	return out.String(), nil
+}
+
+// debugStreamInterval is the default interval at which /debug/stream
+// re-queries the BGP backend, overridable with the "interval" query param.
+const debugStreamInterval = 5 * time.Second
+
+// debugStreamHandler is a Server-Sent-Events endpoint that re-gathers peer
+// status on an interval and pushes peer up/down and state-change deltas, so
+// operators can `curl -N` it and watch session state evolve without
+// polling /status/ in a loop.
+func debugStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	interval := debugStreamInterval
+	if s := r.URL.Query().Get("interval"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			interval = d
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	previous := map[string]Peer{}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			current := Collect().Peers
+
+			currentByAddr := map[string]Peer{}
+			for _, p := range current {
+				currentByAddr[p.PeerAddress] = p
+				prev, existed := previous[p.PeerAddress]
+				switch {
+				case !existed:
+					writeSSEEvent(w, "peer-up", p)
+				case prev.BGPState != p.BGPState || prev.PrefixesReceived != p.PrefixesReceived:
+					writeSSEEvent(w, "peer-changed", p)
+				}
+			}
+			for addr, p := range previous {
+				if _, ok := currentByAddr[addr]; !ok {
+					writeSSEEvent(w, "peer-down", p)
+				}
+			}
+
+			previous = currentByAddr
+			flusher.Flush()
+		}
+	}
+}
+
+// writeSSEEvent writes a single Server-Sent-Event with the given event
+// name and a JSON-encoded data payload.
+func writeSSEEvent(w http.ResponseWriter, event string, data interface{}) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		log.WithError(err).Error("Failed to marshal SSE event")
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+}
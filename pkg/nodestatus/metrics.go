@@ -0,0 +1,118 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nodestatus
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// bgpFSMState maps the textual BGP session state, as reported by BIRD or
+// GoBGP, to the numeric FSM state used by calico_bgp_peer_state.
+var bgpFSMState = map[string]int{
+	"Idle":        0,
+	"Connect":     1,
+	"Active":      2,
+	"OpenSent":    3,
+	"OpenConfirm": 4,
+	"Established": 5,
+	// GoBGP's lower-case states come through strings.Title in this form.
+	"Opensent":    3,
+	"Openconfirm": 4,
+}
+
+// MetricsHandler serves Prometheus-format metrics derived from the same
+// peer discovery used by Status, via Collect, so a scrape runs a single
+// discovery pass shared by every metric rather than one per metric.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	status := Collect()
+
+	fmt.Fprintln(w, "# HELP calico_node_up Whether the calico-node/felix process is running.")
+	fmt.Fprintln(w, "# TYPE calico_node_up gauge")
+	fmt.Fprintf(w, "calico_node_up %d\n", boolToMetric(status.CalicoProcessRunning))
+
+	fmt.Fprintln(w, "# HELP calico_bgp_peer_state BGP peer FSM state (0=idle,1=connect,2=active,3=opensent,4=openconfirm,5=established).")
+	fmt.Fprintln(w, "# TYPE calico_bgp_peer_state gauge")
+	fmt.Fprintln(w, "# HELP calico_bgp_peer_uptime_seconds Seconds since the peer's session last changed state, where known.")
+	fmt.Fprintln(w, "# TYPE calico_bgp_peer_uptime_seconds gauge")
+	fmt.Fprintln(w, "# HELP calico_bgp_peer_prefixes_received Prefixes received from the peer.")
+	fmt.Fprintln(w, "# TYPE calico_bgp_peer_prefixes_received gauge")
+	fmt.Fprintln(w, "# HELP calico_bgp_peer_prefixes_accepted Prefixes accepted from the peer after import filtering.")
+	fmt.Fprintln(w, "# TYPE calico_bgp_peer_prefixes_accepted gauge")
+	fmt.Fprintln(w, "# HELP calico_bgp_peer_messages_sent_total BGP messages sent to the peer.")
+	fmt.Fprintln(w, "# TYPE calico_bgp_peer_messages_sent_total counter")
+	fmt.Fprintln(w, "# HELP calico_bgp_peer_messages_received_total BGP messages received from the peer.")
+	fmt.Fprintln(w, "# TYPE calico_bgp_peer_messages_received_total counter")
+
+	for _, p := range status.Peers {
+		labels := peerLabels(p)
+		fmt.Fprintf(w, "calico_bgp_peer_state{%s} %d\n", labels, bgpFSMState[p.BGPState])
+		if secs, ok := uptimeSeconds(p); ok {
+			fmt.Fprintf(w, "calico_bgp_peer_uptime_seconds{%s} %g\n", labels, secs)
+		}
+		fmt.Fprintf(w, "calico_bgp_peer_prefixes_received{%s} %d\n", labels, p.PrefixesReceived)
+		fmt.Fprintf(w, "calico_bgp_peer_prefixes_accepted{%s} %d\n", labels, p.PrefixesAccepted)
+		fmt.Fprintf(w, "calico_bgp_peer_messages_sent_total{%s} %d\n", labels, p.MessagesSent)
+		fmt.Fprintf(w, "calico_bgp_peer_messages_received_total{%s} %d\n", labels, p.MessagesReceived)
+	}
+}
+
+// peerLabels renders the common Prometheus label set for a peer.
+func peerLabels(p Peer) string {
+	ipv := "4"
+	if strings.Contains(p.PeerAddress, ":") {
+		ipv = "6"
+	}
+	return fmt.Sprintf("peer=%q,peer_type=%q,ipv=%q", p.PeerAddress, p.PeerType, ipv)
+}
+
+// uptimeSeconds converts a peer's "Since" value into seconds, when it's in
+// the "HH:MM:SS" or "Nd HH:MM:SS" form used by GoBGP's formatTimedelta.
+// BIRD reports a coarser date instead, which this intentionally doesn't try
+// to convert.
+func uptimeSeconds(p Peer) (float64, bool) {
+	fields := strings.Fields(p.Since)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	hms := fields[len(fields)-1]
+
+	var days int
+	if len(fields) == 2 {
+		if _, err := fmt.Sscanf(fields[0], "%dd", &days); err != nil {
+			return 0, false
+		}
+	} else if len(fields) != 1 {
+		return 0, false
+	}
+
+	var h, m, s int
+	if _, err := fmt.Sscanf(hms, "%d:%d:%d", &h, &m, &s); err != nil {
+		return 0, false
+	}
+
+	return float64(days*86400 + h*3600 + m*60 + s), true
+}
+
+// boolToMetric renders a bool as the 0/1 a Prometheus gauge expects.
+func boolToMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
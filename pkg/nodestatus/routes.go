@@ -0,0 +1,165 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nodestatus
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	gobgp "github.com/osrg/gobgp/client"
+	"github.com/osrg/gobgp/packet/bgp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Route is a single route accepted from a peer, as returned by
+// /status/routes.
+type Route struct {
+	Prefix  string `json:"prefix"`
+	NextHop string `json:"nextHop,omitempty"`
+}
+
+// routesHandler serves the routes currently accepted from a single peer's
+// protocol instance, named by the "peer" query parameter, so operators can
+// confirm what a session is actually propagating without shelling into the
+// container.
+func routesHandler(w http.ResponseWriter, r *http.Request) {
+	peerName := r.URL.Query().Get("peer")
+	if peerName == "" {
+		http.Error(w, `missing required "peer" query parameter`, http.StatusBadRequest)
+		return
+	}
+	if !bgpPeerRegex.MatchString(peerName) || strings.ContainsAny(peerName, "\r\n") {
+		http.Error(w, `invalid "peer" query parameter`, http.StatusBadRequest)
+		return
+	}
+
+	ipv := "4"
+	if r.URL.Query().Get("ipv") == "6" {
+		ipv = "6"
+	}
+
+	var (
+		routes []Route
+		err    error
+	)
+	if Collect().BGPBackend == "gobgp" {
+		routes, err = queryGoBGPRoutes(ipv, peerName)
+	} else {
+		routes, err = queryBIRDRoutes(ipv, peerName)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(routes); err != nil {
+		log.WithError(err).Error("Failed to encode routes")
+	}
+}
+
+// birdRouteRegex matches a single route line from "show route protocol
+// <name>", e.g. "172.17.8.0/24 via 172.17.8.102 on eth0 [Mesh_172_17_8_102 2016-11-21] * (100)".
+var birdRouteRegex = regexp.MustCompile(`^(\S+)\s+via\s+(\S+)`)
+
+// queryBIRDRoutes issues "show route protocol <name>" against the BIRD
+// control socket for ipv and returns the accepted routes.
+func queryBIRDRoutes(ipv, name string) ([]Route, error) {
+	c, err := dialBIRDSocket(ipv)
+	if err != nil {
+		return nil, fmt.Errorf("error querying BIRD: %w", err)
+	}
+	defer c.Close()
+
+	if _, err := fmt.Fprintf(c, "show route protocol %s\n", name); err != nil {
+		return nil, fmt.Errorf("unable to write to BIRD socket: %w", err)
+	}
+
+	var routes []Route
+	scanner := bufio.NewScanner(c)
+	c.SetReadDeadline(time.Now().Add(birdTimeOut))
+	for scanner.Scan() {
+		str := scanner.Text()
+		if strings.HasPrefix(str, "0000") {
+			break
+		}
+
+		line := str
+		if len(str) > 5 && str[4] == '-' {
+			line = str[5:]
+		} else if strings.HasPrefix(str, " ") {
+			line = str[1:]
+		}
+		if sm := birdRouteRegex.FindStringSubmatch(strings.TrimSpace(line)); sm != nil {
+			routes = append(routes, Route{Prefix: sm[1], NextHop: sm[2]})
+		}
+
+		c.SetReadDeadline(time.Now().Add(birdTimeOut))
+	}
+	return routes, scanner.Err()
+}
+
+// queryGoBGPRoutes returns the routes accepted from the peer described by
+// name (its "Global_"/"Mesh_"/"Node_" protocol name), via GoBGP's RIB for
+// the given address family.
+func queryGoBGPRoutes(ipv, name string) ([]Route, error) {
+	client, err := gobgp.New("")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create gobgp client: %w", err)
+	}
+	defer client.Close()
+
+	afi := bgp.AFI_IP
+	if ipv == "6" {
+		afi = bgp.AFI_IP6
+	}
+
+	ipSep := "."
+	if ipv == "6" {
+		ipSep = ":"
+	}
+	sm := bgpPeerRegex.FindStringSubmatch(name)
+	if len(sm) != 3 {
+		return nil, fmt.Errorf("peer name %q is not of the form Global_/Mesh_/Node_<ip>", name)
+	}
+	peerIP := strings.Replace(sm[2], "_", ipSep, -1)
+
+	dsts, err := client.GetRib(&gobgp.Table{Family: bgp.AfiSafiToRouteFamily(afi, bgp.SAFI_UNICAST)})
+	if err != nil {
+		return nil, fmt.Errorf("unable to query GoBGP RIB: %w", err)
+	}
+
+	var routes []Route
+	for _, dst := range dsts {
+		for _, path := range dst.Paths {
+			source := path.GetSource()
+			if source == nil || source.Address.String() != peerIP {
+				continue
+			}
+			routes = append(routes, Route{
+				Prefix:  dst.Prefix.String(),
+				NextHop: path.GetNexthop().String(),
+			})
+		}
+	}
+	return routes, nil
+}
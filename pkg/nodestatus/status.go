@@ -16,13 +16,16 @@ package nodestatus
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"reflect"
@@ -32,64 +35,193 @@ import (
 	"github.com/osrg/gobgp/packet/bgp"
 	"github.com/shirou/gopsutil/process"
 	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func statusHandler(w http.ResponseWriter, r *http.Request) {
-	Status(w)
+	Status(w, r)
 }
 
 func Run() {
-	http.HandleFunc("/status/", statusHandler)
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// Use an explicit mux rather than http.DefaultServeMux: net/http/pprof
+	// and expvar both register themselves onto DefaultServeMux from their
+	// init() functions as a side effect of NewDebugMux() importing them, and
+	// passing nil to ListenAndServe below means "use DefaultServeMux". An
+	// explicit mux keeps those debug-only handlers off the main status port
+	// regardless of whether --debug-addr is ever set.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status/", statusHandler)
+	mux.HandleFunc("/status/validations", validationsHandler)
+	mux.HandleFunc("/status/routes", routesHandler)
+	mux.HandleFunc("/metrics", MetricsHandler)
+	go defaultValidationManager.Run(30*time.Second, cachedPeers)
+
+	if *debugAddr != "" {
+		log.Infof("Starting debug server on %s", *debugAddr)
+		go func() {
+			log.Fatal(http.ListenAndServe(*debugAddr, NewDebugMux()))
+		}()
+	}
+
+	log.Fatal(http.ListenAndServe(":8080", mux))
+}
+
+var (
+	peerCacheMu sync.RWMutex
+	peerCache   []Peer
+)
+
+// setCachedPeers records the most recently discovered peers, so that other
+// subsystems (the peer validator, the debug endpoints) can consult them
+// without re-querying BIRD/GoBGP themselves.
+func setCachedPeers(peers []Peer) {
+	peerCacheMu.Lock()
+	defer peerCacheMu.Unlock()
+	peerCache = peers
+}
+
+// cachedPeers returns a copy of the most recently discovered peers.
+func cachedPeers() []Peer {
+	peerCacheMu.RLock()
+	defer peerCacheMu.RUnlock()
+	out := make([]Peer, len(peerCache))
+	copy(out, peerCache)
+	return out
+}
+
+// NodeStatus is the top-level, typed representation of calico/node's BGP
+// status. It is built once per request and then handed to a statusEncoder,
+// so the text, JSON and YAML outputs are always derived from the same data.
+type NodeStatus struct {
+	// CalicoProcessRunning is true if a calico-felix (or calico-node -felix)
+	// process was found running on the host.
+	CalicoProcessRunning bool `json:"calicoProcessRunning" yaml:"calicoProcessRunning"`
+
+	// BGPBackend is the BGP backend serving this status: "bird", "gobgp",
+	// or "" if no supported backend process is running.
+	BGPBackend string `json:"bgpBackend" yaml:"bgpBackend"`
+
+	// Peers are the BGP peers discovered for the chosen backend, across
+	// all address families.
+	Peers []Peer `json:"peers" yaml:"peers"`
+
+	// Warnings holds non-fatal, human-readable notices encountered while
+	// gathering status, e.g. an address family with no running daemon.
+	Warnings []string `json:"warnings,omitempty" yaml:"warnings,omitempty"`
 }
 
-// Status prints status of the node and returns error (if any)
-func Status(w http.ResponseWriter) {
+// Peer is the structured representation of a single BGP peer, shared by
+// the text, JSON and YAML encoders.
+type Peer struct {
+	PeerAddress string `json:"peerAddress" yaml:"peerAddress"`
+	PeerType    string `json:"peerType" yaml:"peerType"`
+	AdminState  string `json:"adminState" yaml:"adminState"`
+	BGPState    string `json:"bgpState" yaml:"bgpState"`
+	Since       string `json:"since" yaml:"since"`
+	Info        string `json:"info,omitempty" yaml:"info,omitempty"`
+
+	// ASN is the peer's origin AS number, if known (from BIRD's "Neighbor
+	// AS" or the GoBGP neighbor config).
+	ASN int `json:"asn,omitempty" yaml:"asn,omitempty"`
+
+	// Prefixes are the routes currently accepted from this peer, used by
+	// the IRR/RPKI validators to check specific announcements rather than
+	// just the origin ASN. Left empty when the session isn't established.
+	Prefixes []string `json:"prefixes,omitempty" yaml:"prefixes,omitempty"`
+
+	// The following give richer per-session detail, gathered from BIRD's
+	// `show protocols all <name>` or the equivalent GoBGP neighbor fields.
+	// They are left zero-valued when the backend doesn't report them.
+	PrefixesReceived   int    `json:"prefixesReceived,omitempty" yaml:"prefixesReceived,omitempty"`
+	PrefixesAccepted   int    `json:"prefixesAccepted,omitempty" yaml:"prefixesAccepted,omitempty"`
+	PrefixesAdvertised int    `json:"prefixesAdvertised,omitempty" yaml:"prefixesAdvertised,omitempty"`
+	HoldTime           string `json:"holdTime,omitempty" yaml:"holdTime,omitempty"`
+	KeepaliveTime      string `json:"keepaliveTime,omitempty" yaml:"keepaliveTime,omitempty"`
+	NegotiatedHoldTime string `json:"negotiatedHoldTime,omitempty" yaml:"negotiatedHoldTime,omitempty"`
+	MessagesSent       uint64 `json:"messagesSent,omitempty" yaml:"messagesSent,omitempty"`
+	MessagesReceived   uint64 `json:"messagesReceived,omitempty" yaml:"messagesReceived,omitempty"`
+	LastError          string `json:"lastError,omitempty" yaml:"lastError,omitempty"`
+
+	// Verdict is the combined outcome of the peer validation subsystem
+	// (IRR/RPKI/PeeringDB checks), e.g. "valid", "invalid-origin", "no-rov"
+	// or "unknown". See /status/validations for the per-check detail.
+	Verdict Verdict `json:"verdict,omitempty" yaml:"verdict,omitempty"`
+}
+
+// Status writes the status of the node to w, in the format selected by the
+// "format" query parameter ("text", "json" or "yaml"), falling back to the
+// Accept header and finally to the human-readable text table.
+func Status(w http.ResponseWriter, r *http.Request) {
+	enc := encoderFor(r)
+
 	// Must run this command as root to be able to connect to BIRD sockets
-	err := enforceRoot()
-	if err != nil {
+	if err := enforceRoot(); err != nil {
 		fmt.Fprintln(w, err)
 		return
 	}
 
+	status := Collect()
+	if err := enc.Encode(w, status); err != nil {
+		log.WithError(err).Error("Failed to encode node status")
+	}
+}
+
+// Collect detects the running Calico process and BGP backend, collects
+// the current peers for it, annotates them with their validation verdict,
+// and caches the result for the peer validator and /debug/peers. It is the
+// single place that decides what "the current status" is; Status, the
+// debug peer stream and the metrics exporter all build on it.
+func Collect() *NodeStatus {
+	status := &NodeStatus{}
+
 	// Go through running processes and check if `calico-felix` processes is not running
 	processes, err := process.Processes()
 	if err != nil {
-		fmt.Fprintln(w, err)
+		status.Warnings = append(status.Warnings, err.Error())
 	}
 
 	// For older versions of calico/node, the process was called `calico-felix`. Newer ones use `calico-node -felix`.
 	if !psContains([]string{"calico-felix"}, processes) && !psContains([]string{"calico-node", "-felix"}, processes) {
-		// Return and print message if calico-node is not running
-		fmt.Fprintf(w, "Calico process is not running.\n")
-		return
+		setCachedPeers(nil)
+		return status
 	}
-
-	fmt.Fprintf(w, "Calico process is running.\n")
+	status.CalicoProcessRunning = true
 
 	if psContains([]string{"bird"}, processes) || psContains([]string{"bird6"}, processes) {
-		// Check if birdv4 process is running, print the BGP peer table if it is, else print a warning
+		status.BGPBackend = "bird"
+		// Check if birdv4 process is running, collect the BGP peers if it is, else note a warning.
 		if psContains([]string{"bird"}, processes) {
-			printBIRDPeers(w, "4")
+			peers, warnings := collectBIRDPeers("4")
+			status.Peers = append(status.Peers, peers...)
+			status.Warnings = append(status.Warnings, warnings...)
 		} else {
-			fmt.Fprintf(w, "\nINFO: BIRDv4 process: 'bird' is not running.\n")
+			status.Warnings = append(status.Warnings, "BIRDv4 process: 'bird' is not running.")
 		}
-		// Check if birdv6 process is running, print the BGP peer table if it is, else print a warning
+		// Check if birdv6 process is running, collect the BGP peers if it is, else note a warning.
 		if psContains([]string{"bird6"}, processes) {
-			printBIRDPeers(w, "6")
+			peers, warnings := collectBIRDPeers("6")
+			status.Peers = append(status.Peers, peers...)
+			status.Warnings = append(status.Warnings, warnings...)
 		} else {
-			fmt.Fprintf(w, "\nINFO: BIRDv6 process: 'bird6' is not running.\n")
+			status.Warnings = append(status.Warnings, "BIRDv6 process: 'bird6' is not running.")
 		}
 	} else if psContains([]string{"calico-bgp-daemon"}, processes) {
-		printGoBGPPeers(w, "4")
-		printGoBGPPeers(w, "6")
+		status.BGPBackend = "gobgp"
+		for _, ipv := range []string{"4", "6"} {
+			peers, warnings := collectGoBGPPeers(ipv)
+			status.Peers = append(status.Peers, peers...)
+			status.Warnings = append(status.Warnings, warnings...)
+		}
 	} else {
-		fmt.Fprintf(w, "\nNone of the BGP backend processes (BIRD or GoBGP) are running.\n")
+		status.Warnings = append(status.Warnings, "None of the BGP backend processes (BIRD or GoBGP) are running.")
 	}
 
-	// Have to manually enter an empty line because the table print
-	// library prints the last line, so can't insert a '\n' there
-	fmt.Fprintln(w)
+	for i := range status.Peers {
+		status.Peers[i].Verdict = defaultValidationManager.CombinedVerdict(status.Peers[i].PeerAddress)
+	}
+	setCachedPeers(status.Peers)
+
+	return status
 }
 
 func psContains(proc []string, procList []*process.Process) bool {
@@ -133,17 +265,60 @@ var bgpTypeMap = map[string]string{
 // Timeout for querying BIRD
 var birdTimeOut = 2 * time.Second
 
-// Expected BIRD protocol table columns
+// Expected BIRD protocol table columns. This heading is unchanged between
+// BIRD 1.x and 2.x: "show protocols" still prints name/proto/table/state/
+// since/info on both (verified against BIRD 2.0's birdc output), so there is
+// no BIRD1/BIRD2 dispatch needed at this layer. BIRD 2.x's multiprotocol
+// support only changes the *detail* output of "show protocols all", which is
+// handled separately by queryBIRDPeerDetail's channel-aware parsing.
 var birdExpectedHeadings = []string{"name", "proto", "table", "state", "since", "info"}
 
-// bgpPeer is a structure containing details about a BGP peer.
+// bgpPeer is a structure containing details about a BGP peer, as parsed
+// from BIRD or GoBGP. It is converted to a Peer for rendering.
 type bgpPeer struct {
+	Name     string // BIRD protocol name, e.g. "Mesh_172_17_8_102". Not rendered directly.
 	PeerIP   string
 	PeerType string
 	State    string
 	Since    string
 	BGPState string
 	Info     string
+
+	ASN                int
+	PrefixesReceived   int
+	PrefixesAccepted   int
+	PrefixesAdvertised int
+	HoldTime           string
+	KeepaliveTime      string
+	NegotiatedHoldTime string
+	MessagesSent       uint64
+	MessagesReceived   uint64
+	LastError          string
+	Prefixes           []string
+}
+
+// toPeer converts the internal, backend-specific bgpPeer into the exported
+// Peer type shared by every encoder.
+func (b *bgpPeer) toPeer() Peer {
+	return Peer{
+		PeerAddress:        b.PeerIP,
+		PeerType:           b.PeerType,
+		AdminState:         b.State,
+		BGPState:           b.BGPState,
+		Since:              b.Since,
+		Info:               b.Info,
+		ASN:                b.ASN,
+		PrefixesReceived:   b.PrefixesReceived,
+		PrefixesAccepted:   b.PrefixesAccepted,
+		PrefixesAdvertised: b.PrefixesAdvertised,
+		HoldTime:           b.HoldTime,
+		KeepaliveTime:      b.KeepaliveTime,
+		NegotiatedHoldTime: b.NegotiatedHoldTime,
+		MessagesSent:       b.MessagesSent,
+		MessagesReceived:   b.MessagesReceived,
+		LastError:          b.LastError,
+		Prefixes:           b.Prefixes,
+	}
 }
 
 // Unmarshal a peer from a line in the BIRD protocol output.  Returns true if
@@ -176,6 +351,7 @@ func (b *bgpPeer) unmarshalBIRD(line, ipSep string) bool {
 		return false
 	}
 	var ok bool
+	b.Name = columns[0]
 	b.PeerIP = strings.Replace(sm[2], "_", ipSep, -1)
 	if b.PeerType, ok = bgpTypeMap[sm[1]]; !ok {
 		log.Debugf("Not a valid line: peer type '%s' is not recognized", sm[1])
@@ -193,27 +369,40 @@ func (b *bgpPeer) unmarshalBIRD(line, ipSep string) bool {
 	return true
 }
 
-// printBIRDPeers queries BIRD and displays the local peers in table format.
-func printBIRDPeers(w http.ResponseWriter, ipv string) {
-	log.Debugf("Print BIRD peers for IPv%s", ipv)
+// dialBIRDSocket connects to the BIRD control socket for the given IP
+// version, trying the containerized location first and falling back to the
+// default, non-containerized one.
+func dialBIRDSocket(ipv string) (net.Conn, error) {
 	birdSuffix := ""
 	if ipv == "6" {
 		birdSuffix = "6"
 	}
 
-	fmt.Fprintf(w, "\nIPv%s BGP status\n", ipv)
-
 	// Try connecting to the bird socket in `/var/run/calico/` first to get the data
 	c, err := net.Dial("unix", fmt.Sprintf("/var/run/calico/bird%s.ctl", birdSuffix))
+	if err == nil {
+		return c, nil
+	}
+
+	// If that fails, try connecting to bird socket in `/var/run/bird` (which is the
+	// default socket location for bird install) for non-containerized installs
+	log.Debugln("Failed to connect to BIRD socket in /var/run/calico, trying /var/run/bird")
+	c, err = net.Dial("unix", fmt.Sprintf("/var/run/bird/bird%s.ctl", birdSuffix))
 	if err != nil {
-		// If that fails, try connecting to bird socket in `/var/run/bird` (which is the
-		// default socket location for bird install) for non-containerized installs
-		log.Debugln("Failed to connect to BIRD socket in /var/run/calic, trying /var/run/bird")
-		c, err = net.Dial("unix", fmt.Sprintf("/var/run/bird/bird%s.ctl", birdSuffix))
-		if err != nil {
-			fmt.Fprintf(w, "Error querying BIRD: unable to connect to BIRDv%s socket: %v", ipv, err)
-			return
-		}
+		return nil, fmt.Errorf("unable to connect to BIRDv%s socket: %w", ipv, err)
+	}
+	return c, nil
+}
+
+// collectBIRDPeers queries BIRD and returns the local peers for the given
+// IP version, along with any human-readable warnings encountered along the
+// way (e.g. a connection failure or an empty peer set).
+func collectBIRDPeers(ipv string) ([]Peer, []string) {
+	log.Debugf("Collect BIRD peers for IPv%s", ipv)
+
+	c, err := dialBIRDSocket(ipv)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("Error querying BIRD: %v", err)}
 	}
 	defer c.Close()
 
@@ -224,34 +413,170 @@ func printBIRDPeers(w http.ResponseWriter, ipv string) {
 	// Send the request.
 	_, err = c.Write([]byte("show protocols\n"))
 	if err != nil {
-		fmt.Fprintf(w, "Error executing command: unable to write to BIRD socket: %s\n", err)
-		return
+		return nil, []string{fmt.Sprintf("Error executing command: unable to write to BIRD socket: %s", err)}
 	}
 
 	// Scan the output and collect parsed BGP peers
 	log.Debugln("Reading output from BIRD")
-	peers, err := scanBIRDPeers(ipv, c)
+	peers, majorVersion, err := scanBIRDPeers(ipv, c)
 	if err != nil {
-		fmt.Fprintf(w, "Error executing command: %v", err)
-		return
+		return nil, []string{fmt.Sprintf("Error executing command: %v", err)}
 	}
 
-	// If no peers were returned then just print a message.
+	// If no peers were returned then just note it.
 	if len(peers) == 0 {
-		fmt.Fprintf(w, "No IPv%s peers found.\n", ipv)
-		return
+		return nil, []string{fmt.Sprintf("No IPv%s peers found.", ipv)}
+	}
+
+	// For every peer, issue a follow-up "show protocols all" query on the
+	// same connection to pull richer session detail (prefix counts, timers,
+	// last error). BIRD's control socket is a simple request/response
+	// protocol, so this is safe to do sequentially. This intentionally
+	// includes peers that aren't currently up: the last session-termination
+	// reason is only useful for diagnosing a flapped or down session, which
+	// is exactly the case a State-based skip would hide it for.
+	for i := range peers {
+		if err := queryBIRDPeerDetail(c, &peers[i], ipv, majorVersion); err != nil {
+			log.WithError(err).Debugf("Failed to query detail for BIRD peer %s", peers[i].Name)
+		}
+		if peers[i].BGPState != "Established" {
+			continue
+		}
+		routes, err := queryBIRDRoutes(ipv, peers[i].Name)
+		if err != nil {
+			log.WithError(err).Debugf("Failed to query routes for BIRD peer %s", peers[i].Name)
+			continue
+		}
+		for _, route := range routes {
+			peers[i].Prefixes = append(peers[i].Prefixes, route.Prefix)
+		}
 	}
 
-	// Finally, print the peers.
-	printPeers(peers)
+	result := make([]Peer, 0, len(peers))
+	for i := range peers {
+		result = append(result, peers[i].toPeer())
+	}
+	return result, nil
+}
+
+// birdChannelRegex matches a BIRD 2.x channel header in "show protocols
+// all" output, e.g. "Channel ipv4" or "Channel ipv6". BIRD 2 groups a
+// multiprotocol BGP session's per-family state (routes, import/export
+// state) under one of these per channel, rather than a single flat block.
+var birdChannelRegex = regexp.MustCompile(`^Channel (ipv4|ipv6)$`)
+
+// queryBIRDPeerDetail issues a "show protocols all <name>" query on conn
+// and folds the resulting indented detail block into peer.
+//
+// On BIRD 1.x the block is flat and every line is folded in unconditionally.
+// On BIRD 2.x the block is split into "Channel ipv4"/"Channel ipv6"
+// sub-blocks; only the one matching ipv is folded in, so a dual-stack
+// protocol instance doesn't mix its v4 and v6 counters together.
+func queryBIRDPeerDetail(conn net.Conn, peer *bgpPeer, ipv string, majorVersion int) error {
+	_, err := conn.Write([]byte(fmt.Sprintf("show protocols all %s\n", peer.Name)))
+	if err != nil {
+		return fmt.Errorf("unable to write to BIRD socket: %s", err)
+	}
+
+	wantChannel := "ipv4"
+	if ipv == "6" {
+		wantChannel = "ipv6"
+	}
+	// BIRD 1.x has no channel concept, so there's nothing to filter on.
+	inWantedChannel := majorVersion < 2
+
+	scanner := bufio.NewScanner(conn)
+	conn.SetReadDeadline(time.Now().Add(birdTimeOut))
+	for scanner.Scan() {
+		str := scanner.Text()
+		if strings.HasPrefix(str, "0000") {
+			break
+		}
+		// Strip the leading BIRD reply code ("1006-", "1006 ") if present,
+		// otherwise this is a continuation line indented with a single space.
+		line := str
+		if len(str) > 5 && str[4] == '-' {
+			line = str[5:]
+		} else if strings.HasPrefix(str, " ") {
+			line = str[1:]
+		}
+		line = strings.TrimSpace(line)
+
+		if sm := birdChannelRegex.FindStringSubmatch(line); sm != nil {
+			inWantedChannel = sm[1] == wantChannel
+			continue
+		}
+		// Route/prefix counters are per-channel on BIRD 2.x, so only fold
+		// those in for the channel we asked about; everything else
+		// (session timers, ASN, last error) is channel-independent.
+		if birdRoutesRegex.MatchString(line) && !inWantedChannel {
+			continue
+		}
+		parseBIRDPeerDetailLine(peer, line)
+
+		conn.SetReadDeadline(time.Now().Add(birdTimeOut))
+	}
+	return scanner.Err()
+}
+
+// Regexes for the fields we care about in "show protocols all" output, e.g.:
+//
+//	Neighbor AS:      64512
+//	Routes:         5 imported, 0 filtered, 3 exported, 5 preferred
+//	Hold timer:       136/180
+//	Keepalive timer:  16/60
+//	Last error:       Socket: Connection reset by peer
+var (
+	birdNeighborASRegex = regexp.MustCompile(`^Neighbor AS:\s+(\d+)`)
+	birdRoutesRegex     = regexp.MustCompile(`^Routes:\s+(\d+) imported.*?(\d+) exported`)
+	birdHoldTimerRegex  = regexp.MustCompile(`^Hold timer:\s+(\S+)/(\S+)`)
+	birdKeepaliveRegex  = regexp.MustCompile(`^Keepalive timer:\s+([^/\s]+)`)
+	birdLastErrorRegex  = regexp.MustCompile(`^Last error:\s+(.+)$`)
+)
+
+// parseBIRDPeerDetailLine folds a single, already-trimmed line from "show
+// protocols all" into peer.
+func parseBIRDPeerDetailLine(peer *bgpPeer, line string) {
+	switch {
+	case birdNeighborASRegex.MatchString(line):
+		sm := birdNeighborASRegex.FindStringSubmatch(line)
+		peer.ASN, _ = strconv.Atoi(sm[1])
+	case birdRoutesRegex.MatchString(line):
+		sm := birdRoutesRegex.FindStringSubmatch(line)
+		peer.PrefixesAccepted, _ = strconv.Atoi(sm[1])
+		peer.PrefixesReceived = peer.PrefixesAccepted
+		peer.PrefixesAdvertised, _ = strconv.Atoi(sm[2])
+	case birdHoldTimerRegex.MatchString(line):
+		sm := birdHoldTimerRegex.FindStringSubmatch(line)
+		peer.HoldTime = sm[1]
+		peer.NegotiatedHoldTime = sm[2]
+	case birdKeepaliveRegex.MatchString(line):
+		sm := birdKeepaliveRegex.FindStringSubmatch(line)
+		peer.KeepaliveTime = sm[1]
+	case birdLastErrorRegex.MatchString(line):
+		sm := birdLastErrorRegex.FindStringSubmatch(line)
+		peer.LastError = sm[1]
+	}
+}
+
+// birdReadyRegex matches the banner BIRD sends at the start of every
+// session, e.g. "0001 BIRD 1.6.8 ready." or "0001 BIRD 2.0.7 ready.".
+var birdReadyRegex = regexp.MustCompile(`^0001 BIRD (\S+) ready\.$`)
+
+// birdMajorVersion returns the major version number from a BIRD version
+// string such as "2.0.7", or 0 if it can't be determined.
+func birdMajorVersion(version string) int {
+	major, _ := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	return major
 }
 
 // scanBIRDPeers scans through BIRD output to return a slice of bgpPeer
-// structs.
+// structs, along with the BIRD major version reported in the banner (1 if
+// it can't be determined, since that's the format this parser defaults to).
 //
-// We split this out from the main printBIRDPeers() function to allow us to
+// We split this out from the main collectBIRDPeers() function to allow us to
 // test this processing in isolation.
-func scanBIRDPeers(ipv string, conn net.Conn) ([]bgpPeer, error) {
+func scanBIRDPeers(ipv string, conn net.Conn) ([]bgpPeer, int, error) {
 	// Determine the separator to use for an IP address, based on the
 	// IP version.
 	ipSep := "."
@@ -268,8 +593,13 @@ func scanBIRDPeers(ipv string, conn net.Conn) ([]bgpPeer, error) {
 	//  	 direct1  Direct   master   up     2016-11-21
 	//  	 Mesh_172_17_8_102 BGP      master   up     2016-11-21  Established
 	// 	0000
+	//
+	// BIRD 2.x uses the same table format for "show protocols"; the
+	// version only matters for "show protocols all", which gains
+	// per-channel (ipv4/ipv6) blocks - see queryBIRDPeerDetail.
 	scanner := bufio.NewScanner(conn)
 	peers := []bgpPeer{}
+	majorVersion := 1
 
 	// Set a time-out for reading from the socket connection.
 	conn.SetReadDeadline(time.Now().Add(birdTimeOut))
@@ -283,12 +613,17 @@ func scanBIRDPeers(ipv string, conn net.Conn) ([]bgpPeer, error) {
 			// "0000" means end of data
 			break
 		} else if strings.HasPrefix(str, "0001") {
-			// "0001" code means BIRD is ready.
+			// "0001" code means BIRD is ready, and carries its version.
+			if sm := birdReadyRegex.FindStringSubmatch(str); sm != nil {
+				if v := birdMajorVersion(sm[1]); v > 0 {
+					majorVersion = v
+				}
+			}
 		} else if strings.HasPrefix(str, "2002") {
 			// "2002" code means start of headings
 			f := strings.Fields(str[5:])
 			if !reflect.DeepEqual(f, birdExpectedHeadings) {
-				return nil, errors.New("unknown BIRD table output format")
+				return nil, majorVersion, errors.New("unknown BIRD table output format")
 			}
 		} else if strings.HasPrefix(str, "1002") {
 			// "1002" code means first row of data.
@@ -304,7 +639,7 @@ func scanBIRDPeers(ipv string, conn net.Conn) ([]bgpPeer, error) {
 			}
 		} else {
 			// Format of row is unexpected.
-			return nil, errors.New("unexpected output line from BIRD")
+			return nil, majorVersion, errors.New("unexpected output line from BIRD")
 		}
 
 		// Before reading the next line, adjust the time-out for
@@ -312,15 +647,37 @@ func scanBIRDPeers(ipv string, conn net.Conn) ([]bgpPeer, error) {
 		conn.SetReadDeadline(time.Now().Add(birdTimeOut))
 	}
 
-	return peers, scanner.Err()
+	return peers, majorVersion, scanner.Err()
+}
+
+// formatTimedelta renders a duration, given in seconds, the same way the
+// GoBGP CLI does: "HH:MM:SS", or "Nd HH:MM:SS" once it spans a day.
+func formatTimedelta(d int64) string {
+	u := uint64(d)
+	neg := d < 0
+	if neg {
+		u = -u
+	}
+	secs := u % 60
+	u /= 60
+	mins := u % 60
+	u /= 60
+	hours := u % 24
+	days := u / 24
+
+	if days == 0 {
+		return fmt.Sprintf("%02d:%02d:%02d", hours, mins, secs)
+	}
+	return fmt.Sprintf("%dd ", days) + fmt.Sprintf("%02d:%02d:%02d", hours, mins, secs)
 }
 
-// printGoBGPPeers queries GoBGP and displays the local peers in table format.
-func printGoBGPPeers(w http.ResponseWriter, ipv string) {
+// collectGoBGPPeers queries GoBGP and returns the local peers for the given
+// IP version, along with any human-readable warnings encountered along the
+// way.
+func collectGoBGPPeers(ipv string) ([]Peer, []string) {
 	client, err := gobgp.New("")
 	if err != nil {
-		fmt.Fprintf(w, "Error creating gobgp client: %s\n", err)
-		return
+		return nil, []string{fmt.Sprintf("Error creating gobgp client: %s", err)}
 	}
 	defer client.Close()
 
@@ -329,32 +686,9 @@ func printGoBGPPeers(w http.ResponseWriter, ipv string) {
 		afi = bgp.AFI_IP6
 	}
 
-	fmt.Fprintf(w, "\nIPv%s BGP status\n", ipv)
-
 	neighbors, err := client.ListNeighborByTransport(afi)
 	if err != nil {
-		fmt.Fprintf(w, "Error retrieving neighbor info: %s\n", err)
-		return
-	}
-
-	formatTimedelta := func(d int64) string {
-		u := uint64(d)
-		neg := d < 0
-		if neg {
-			u = -u
-		}
-		secs := u % 60
-		u /= 60
-		mins := u % 60
-		u /= 60
-		hours := u % 24
-		days := u / 24
-
-		if days == 0 {
-			return fmt.Sprintf("%02d:%02d:%02d", hours, mins, secs)
-		} else {
-			return fmt.Sprintf("%dd ", days) + fmt.Sprintf("%02d:%02d:%02d", hours, mins, secs)
-		}
+		return nil, []string{fmt.Sprintf("Error retrieving neighbor info: %s", err)}
 	}
 
 	now := time.Now()
@@ -387,42 +721,188 @@ func printGoBGPPeers(w http.ResponseWriter, ipv string) {
 			continue
 		}
 
-		peers = append(peers, bgpPeer{
-			PeerIP:   ipString,
-			PeerType: typ,
-			State:    adminState,
-			Since:    timeStr,
-			BGPState: sessionState,
-		})
+		peer := bgpPeer{
+			PeerIP:             ipString,
+			PeerType:           typ,
+			State:              adminState,
+			Since:              timeStr,
+			BGPState:           sessionState,
+			ASN:                int(n.Config.PeerAs),
+			HoldTime:           fmt.Sprintf("%d", n.Timers.State.HoldTime),
+			KeepaliveTime:      fmt.Sprintf("%d", n.Timers.State.KeepaliveInterval),
+			NegotiatedHoldTime: fmt.Sprintf("%d", n.Timers.State.NegotiatedHoldTime),
+			MessagesSent:       n.State.Messages.Sent.Total,
+			MessagesReceived:   n.State.Messages.Received.Total,
+		}
+
+		// Per-address-family prefix counters, from the AfiSafis entry
+		// matching the family we're querying. A multiprotocol neighbor can
+		// have several entries (e.g. ipv4-unicast and ipv6-unicast), so we
+		// can't just take the first one.
+		wantFamily := bgp.AfiSafiToRouteFamily(afi, bgp.SAFI_UNICAST)
+		for _, afiSafi := range n.AfiSafis {
+			if afiSafi.Config.Family != wantFamily {
+				continue
+			}
+			peer.PrefixesReceived = int(afiSafi.State.Received)
+			peer.PrefixesAccepted = int(afiSafi.State.Accepted)
+			peer.PrefixesAdvertised = int(afiSafi.State.Advertised)
+			break
+		}
+
+		if sessionState == "Established" {
+			if routes, err := queryGoBGPRoutes(ipv, description); err != nil {
+				log.WithError(err).Debugf("Failed to query routes for GoBGP peer %s", description)
+			} else {
+				for _, route := range routes {
+					peer.Prefixes = append(peer.Prefixes, route.Prefix)
+				}
+			}
+		}
+
+		peers = append(peers, peer)
 	}
 
-	// If no peers were returned then just print a message.
+	// If no peers were returned then just note it.
 	if len(peers) == 0 {
-		fmt.Fprintf(w, "No IPv%s peers found.\n", ipv)
-		return
+		return nil, []string{fmt.Sprintf("No IPv%s peers found.", ipv)}
 	}
 
-	// Finally, print the peers.
-	printPeers(peers)
+	result := make([]Peer, 0, len(peers))
+	for i := range peers {
+		result = append(result, peers[i].toPeer())
+	}
+	return result, nil
 }
 
-// TODO: Need to figure out how to get tablewriter to write to the ResponseWriter
-// printPeers prints out the slice of peers in table format.
-func printPeers(peers []bgpPeer) {
-	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"Peer address", "Peer type", "State", "Since", "Info"})
+// statusEncoder renders a NodeStatus to an http.ResponseWriter.
+type statusEncoder interface {
+	Encode(w http.ResponseWriter, status *NodeStatus) error
+}
+
+// encoderFor selects the encoder to use for a request: the "format" query
+// parameter takes priority, falling back to the Accept header and finally
+// to the human-readable text table.
+func encoderFor(r *http.Request) statusEncoder {
+	format := ""
+	if r != nil {
+		format = strings.ToLower(r.URL.Query().Get("format"))
+		if format == "" {
+			accept := r.Header.Get("Accept")
+			switch {
+			case strings.Contains(accept, "json"):
+				format = "json"
+			case strings.Contains(accept, "yaml"):
+				format = "yaml"
+			}
+		}
+	}
+
+	switch format {
+	case "json":
+		return jsonEncoder{}
+	case "yaml", "yml":
+		return yamlEncoder{}
+	default:
+		return textEncoder{}
+	}
+}
+
+// jsonEncoder renders a NodeStatus as JSON.
+type jsonEncoder struct{}
+
+func (jsonEncoder) Encode(w http.ResponseWriter, status *NodeStatus) error {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(status)
+}
+
+// yamlEncoder renders a NodeStatus as YAML.
+type yamlEncoder struct{}
+
+func (yamlEncoder) Encode(w http.ResponseWriter, status *NodeStatus) error {
+	w.Header().Set("Content-Type", "application/x-yaml")
+	b, err := yaml.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// textEncoder renders a NodeStatus as the original human-readable table,
+// grouping peers by address family the way the old printBIRDPeers and
+// printGoBGPPeers functions used to.
+type textEncoder struct{}
+
+func (textEncoder) Encode(w http.ResponseWriter, status *NodeStatus) error {
+	if !status.CalicoProcessRunning {
+		fmt.Fprintf(w, "Calico process is not running.\n")
+		return nil
+	}
+	fmt.Fprintf(w, "Calico process is running.\n")
+
+	for _, warning := range status.Warnings {
+		fmt.Fprintf(w, "\nINFO: %s\n", warning)
+	}
+
+	if status.BGPBackend != "" {
+		v4peers, v6peers := splitPeersByFamily(status.Peers)
+		fmt.Fprintf(w, "\nIPv4 BGP status\n")
+		printPeers(w, v4peers)
+		fmt.Fprintf(w, "\nIPv6 BGP status\n")
+		printPeers(w, v6peers)
+	}
+
+	// Have to manually enter an empty line because the table print
+	// library prints the last line, so can't insert a '\n' there
+	fmt.Fprintln(w)
+	return nil
+}
+
+// splitPeersByFamily splits peers into IPv4 and IPv6 groups, based on
+// whether the peer address contains a ":".
+func splitPeersByFamily(peers []Peer) (v4, v6 []Peer) {
+	for _, p := range peers {
+		if strings.Contains(p.PeerAddress, ":") {
+			v6 = append(v6, p)
+		} else {
+			v4 = append(v4, p)
+		}
+	}
+	return v4, v6
+}
+
+// printPeers prints out the slice of peers in table format to w.
+func printPeers(w http.ResponseWriter, peers []Peer) {
+	if len(peers) == 0 {
+		fmt.Fprintf(w, "No peers found.\n")
+		return
+	}
+
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Peer address", "Peer type", "State", "Since", "Info", "Prefixes (rcvd/acc/adv)", "Last error", "Validation"})
 
 	for _, peer := range peers {
 		info := peer.BGPState
 		if peer.Info != "" {
 			info += " " + peer.Info
 		}
+		prefixes := fmt.Sprintf("%d/%d/%d", peer.PrefixesReceived, peer.PrefixesAccepted, peer.PrefixesAdvertised)
+		verdict := peer.Verdict
+		if verdict == "" {
+			verdict = VerdictUnknown
+		}
 		row := []string{
-			peer.PeerIP,
+			peer.PeerAddress,
 			peer.PeerType,
-			peer.State,
+			peer.AdminState,
 			peer.Since,
 			info,
+			prefixes,
+			peer.LastError,
+			string(verdict),
 		}
 		table.Append(row)
 	}
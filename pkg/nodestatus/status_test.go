@@ -0,0 +1,192 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nodestatus
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestBirdMajorVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    int
+	}{
+		{"1.6.8", 1},
+		{"2.0.7", 2},
+		{"2.0.8-1", 2},
+		{"not-a-version", 0},
+	}
+	for _, tt := range tests {
+		if got := birdMajorVersion(tt.version); got != tt.want {
+			t.Errorf("birdMajorVersion(%q) = %d, want %d", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestParseBIRDPeerDetailLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want bgpPeer
+	}{
+		{
+			name: "neighbor AS",
+			line: "Neighbor AS:      64512",
+			want: bgpPeer{ASN: 64512},
+		},
+		{
+			name: "routes",
+			line: "Routes:         5 imported, 0 filtered, 3 exported, 5 preferred",
+			want: bgpPeer{PrefixesAccepted: 5, PrefixesReceived: 5, PrefixesAdvertised: 3},
+		},
+		{
+			name: "hold timer",
+			line: "Hold timer:       136/180",
+			want: bgpPeer{HoldTime: "136", NegotiatedHoldTime: "180"},
+		},
+		{
+			name: "keepalive timer",
+			line: "Keepalive timer:  16/60",
+			want: bgpPeer{KeepaliveTime: "16"},
+		},
+		{
+			name: "last error",
+			line: "Last error:       Socket: Connection reset by peer",
+			want: bgpPeer{LastError: "Socket: Connection reset by peer"},
+		},
+		{
+			name: "unrecognized line",
+			line: "Preference:       100",
+			want: bgpPeer{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := bgpPeer{}
+			parseBIRDPeerDetailLine(&peer, tt.line)
+			if !reflect.DeepEqual(peer, tt.want) {
+				t.Errorf("parseBIRDPeerDetailLine(%q) = %+v, want %+v", tt.line, peer, tt.want)
+			}
+		})
+	}
+}
+
+// fakeBIRDReader serves a canned, newline-terminated BIRD response over one
+// end of a net.Pipe to a caller that only reads, e.g. scanBIRDPeers.
+func fakeBIRDReader(t *testing.T, response string) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		defer server.Close()
+		server.Write([]byte(response))
+	}()
+	return client
+}
+
+// fakeBIRDConn serves a canned, newline-terminated BIRD response over one
+// end of a net.Pipe, first draining the command written by the caller, e.g.
+// queryBIRDPeerDetail.
+func fakeBIRDConn(t *testing.T, response string) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		defer server.Close()
+		buf := make([]byte, 4096)
+		server.Read(buf) // drain the command line
+		server.Write([]byte(response))
+	}()
+	return client
+}
+
+func TestScanBIRDPeersBIRD1(t *testing.T) {
+	response := "0001 BIRD 1.6.8 ready.\n" +
+		"2002-name     proto    table    state  since       info\n" +
+		"1002-kernel1  Kernel   master   up     2016-11-21\n" +
+		" Mesh_172_17_8_102 BGP      master   up     2016-11-21  Established\n" +
+		"0000 \n"
+
+	conn := fakeBIRDReader(t, response)
+	peers, major, err := scanBIRDPeers("4", conn)
+	if err != nil {
+		t.Fatalf("scanBIRDPeers returned error: %v", err)
+	}
+	if major != 1 {
+		t.Errorf("major version = %d, want 1", major)
+	}
+	if len(peers) != 1 {
+		t.Fatalf("got %d peers, want 1", len(peers))
+	}
+	if peers[0].PeerIP != "172.17.8.102" || peers[0].BGPState != "Established" {
+		t.Errorf("unexpected peer: %+v", peers[0])
+	}
+}
+
+func TestScanBIRDPeersBIRD2(t *testing.T) {
+	response := "0001 BIRD 2.0.7 ready.\n" +
+		"2002-name     proto    table    state  since       info\n" +
+		"1002-Mesh_172_17_8_102 BGP      master   up     2016-11-21  Established\n" +
+		"0000 \n"
+
+	conn := fakeBIRDReader(t, response)
+	peers, major, err := scanBIRDPeers("4", conn)
+	if err != nil {
+		t.Fatalf("scanBIRDPeers returned error: %v", err)
+	}
+	if major != 2 {
+		t.Errorf("major version = %d, want 2", major)
+	}
+	if len(peers) != 1 {
+		t.Fatalf("got %d peers, want 1", len(peers))
+	}
+}
+
+func TestScanBIRDPeersUnexpectedHeading(t *testing.T) {
+	response := "0001 BIRD 1.6.8 ready.\n" +
+		"2002-name     type    table    state  since       info\n" +
+		"0000 \n"
+
+	conn := fakeBIRDReader(t, response)
+	if _, _, err := scanBIRDPeers("4", conn); err == nil {
+		t.Error("expected an error for an unexpected heading row, got nil")
+	}
+}
+
+func TestQueryBIRDPeerDetailChannelFiltering(t *testing.T) {
+	// BIRD 2.x groups per-family detail under "Channel ipv4"/"Channel ipv6"
+	// sub-blocks; querying for ipv4 should only pick up the ipv4 route counts.
+	response := "1006-BGP state: Established\n" +
+		"    Neighbor AS: 64512\n" +
+		"    Channel ipv4\n" +
+		"    Routes:         5 imported, 0 filtered, 3 exported, 5 preferred\n" +
+		"    Channel ipv6\n" +
+		"    Routes:         9 imported, 0 filtered, 7 exported, 9 preferred\n" +
+		"0000 \n"
+
+	conn := fakeBIRDConn(t, response)
+	peer := bgpPeer{Name: "Mesh_172_17_8_102"}
+	if err := queryBIRDPeerDetail(conn, &peer, "4", 2); err != nil {
+		t.Fatalf("queryBIRDPeerDetail returned error: %v", err)
+	}
+	if peer.ASN != 64512 {
+		t.Errorf("ASN = %d, want 64512", peer.ASN)
+	}
+	if peer.PrefixesAccepted != 5 || peer.PrefixesAdvertised != 3 {
+		t.Errorf("got accepted=%d advertised=%d, want accepted=5 advertised=3", peer.PrefixesAccepted, peer.PrefixesAdvertised)
+	}
+}
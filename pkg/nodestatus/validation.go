@@ -0,0 +1,501 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nodestatus
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Verdict is the outcome of validating a BGP peer's announced routes
+// against an external source of truth.
+type Verdict string
+
+const (
+	VerdictValid          Verdict = "valid"
+	VerdictInvalidOrigin  Verdict = "invalid-origin"
+	VerdictPrefixMismatch Verdict = "prefix-mismatch"
+	VerdictNoROV          Verdict = "no-rov"
+	VerdictUnknown        Verdict = "unknown"
+)
+
+// PeerValidator checks a single BGP peer against one external source of
+// truth and reports a Verdict for it.
+type PeerValidator interface {
+	// Name identifies the validator, e.g. "irr", "rpki" or "peeringdb".
+	Name() string
+	// Check validates the given peer and returns a verdict.
+	Check(ctx context.Context, peer Peer) (Verdict, error)
+	// NextRun returns when this validator should next run, given the time
+	// of its last run and whether that run failed.
+	NextRun(last time.Time, failed bool) time.Time
+}
+
+// ValidationResult is the detailed outcome of a single validator run
+// against a single peer, as returned by /status/validations.
+type ValidationResult struct {
+	Peer      string    `json:"peer"`
+	Validator string    `json:"validator"`
+	Verdict   Verdict   `json:"verdict"`
+	Err       string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// validatorSchedule tracks the run state of a single PeerValidator.
+type validatorSchedule struct {
+	validator PeerValidator
+	lastRun   time.Time
+	nextRun   time.Time
+}
+
+// validationManager runs a set of PeerValidators against the currently
+// known peers on a schedule, and caches the results for the status and
+// /status/validations endpoints.
+type validationManager struct {
+	mu        sync.RWMutex
+	schedules []*validatorSchedule
+	results   map[string]map[string]ValidationResult // peer address -> validator name -> result
+}
+
+func newValidationManager(validators ...PeerValidator) *validationManager {
+	vm := &validationManager{
+		results: map[string]map[string]ValidationResult{},
+	}
+	for _, v := range validators {
+		vm.schedules = append(vm.schedules, &validatorSchedule{validator: v})
+	}
+	return vm
+}
+
+// defaultValidationManager is populated with the standard IRR/RPKI/PeeringDB
+// validators and driven by Run().
+var defaultValidationManager = newValidationManager(
+	&irrValidator{whoisAddr: "whois.radb.net:43"},
+	&rpkiValidator{},
+	&peeringDBValidator{apiBase: "https://www.peeringdb.com/api"},
+)
+
+// Run starts the validation scheduler, checking every interval for
+// validators that are due and running them against currentPeers(). It
+// blocks, and is intended to be started in its own goroutine.
+func (vm *validationManager) Run(interval time.Duration, currentPeers func() []Peer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		vm.runDue(currentPeers())
+	}
+}
+
+// validatorCheckTimeout bounds how long a single PeerValidator.Check may run.
+// Without it, a single wedged dependency (e.g. a black-holed whois TCP
+// connection) would block runDue indefinitely, stalling every other
+// validator and peer behind it.
+const validatorCheckTimeout = 10 * time.Second
+
+// runDue runs every validator whose schedule has come due against peers.
+func (vm *validationManager) runDue(peers []Peer) {
+	now := time.Now()
+	for _, sched := range vm.schedules {
+		if !sched.nextRun.IsZero() && now.Before(sched.nextRun) {
+			continue
+		}
+
+		failed := false
+		for _, peer := range peers {
+			ctx, cancel := context.WithTimeout(context.Background(), validatorCheckTimeout)
+			verdict, err := sched.validator.Check(ctx, peer)
+			cancel()
+			result := ValidationResult{
+				Peer:      peer.PeerAddress,
+				Validator: sched.validator.Name(),
+				Verdict:   verdict,
+				CheckedAt: now,
+			}
+			if err != nil {
+				failed = true
+				result.Err = err.Error()
+				log.WithError(err).Warnf("Validator %s failed for peer %s", sched.validator.Name(), peer.PeerAddress)
+			}
+
+			vm.mu.Lock()
+			if vm.results[peer.PeerAddress] == nil {
+				vm.results[peer.PeerAddress] = map[string]ValidationResult{}
+			}
+			vm.results[peer.PeerAddress][sched.validator.Name()] = result
+			vm.mu.Unlock()
+		}
+
+		sched.lastRun = now
+		sched.nextRun = sched.validator.NextRun(now, failed)
+	}
+}
+
+// CombinedVerdict folds the per-validator results for a peer into a single
+// overall verdict. An invalid origin from any validator takes precedence,
+// followed by a PeeringDB prefix-count mismatch and then a missing-ROV
+// result; otherwise the peer is "valid" if at least one validator found it
+// valid, and "unknown" if none did.
+func (vm *validationManager) CombinedVerdict(peerAddress string) Verdict {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+
+	byValidator, ok := vm.results[peerAddress]
+	if !ok || len(byValidator) == 0 {
+		return VerdictUnknown
+	}
+
+	sawPrefixMismatch := false
+	sawNoROV := false
+	sawValid := false
+	for _, r := range byValidator {
+		switch r.Verdict {
+		case VerdictInvalidOrigin:
+			return VerdictInvalidOrigin
+		case VerdictPrefixMismatch:
+			sawPrefixMismatch = true
+		case VerdictNoROV:
+			sawNoROV = true
+		case VerdictValid:
+			sawValid = true
+		}
+	}
+	if sawPrefixMismatch {
+		return VerdictPrefixMismatch
+	}
+	if sawNoROV {
+		return VerdictNoROV
+	}
+	if sawValid {
+		return VerdictValid
+	}
+	return VerdictUnknown
+}
+
+// Results returns a flat copy of every cached validation result, used by
+// the /status/validations endpoint.
+func (vm *validationManager) Results() []ValidationResult {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+
+	out := []ValidationResult{}
+	for _, byValidator := range vm.results {
+		for _, r := range byValidator {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// validationsHandler serves the full per-check validation detail, including
+// timestamps, for every peer and validator.
+func validationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(defaultValidationManager.Results()); err != nil {
+		log.WithError(err).Error("Failed to encode validation results")
+	}
+}
+
+// irrValidator confirms that every prefix a peer currently advertises is
+// covered by a route (or route6) object registered against its origin ASN
+// in the IRR, via a whois query against whois.radb.net.
+type irrValidator struct {
+	whoisAddr string
+}
+
+func (v *irrValidator) Name() string { return "irr" }
+
+func (v *irrValidator) NextRun(last time.Time, failed bool) time.Time {
+	if failed {
+		return last.Add(5 * time.Minute)
+	}
+	return last.Add(30 * time.Minute)
+}
+
+func (v *irrValidator) Check(ctx context.Context, peer Peer) (Verdict, error) {
+	if peer.ASN == 0 {
+		return VerdictUnknown, nil
+	}
+	if len(peer.Prefixes) == 0 {
+		return VerdictUnknown, nil
+	}
+
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", v.whoisAddr)
+	if err != nil {
+		return VerdictUnknown, fmt.Errorf("unable to connect to %s: %w", v.whoisAddr, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := fmt.Fprintf(conn, "-i origin AS%d\n", peer.ASN); err != nil {
+		return VerdictUnknown, fmt.Errorf("unable to query whois: %w", err)
+	}
+
+	routeObject := "route:"
+	if strings.Contains(peer.PeerAddress, ":") {
+		routeObject = "route6:"
+	}
+
+	var registered []*net.IPNet
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, routeObject) {
+			if _, n, err := net.ParseCIDR(strings.TrimSpace(strings.TrimPrefix(line, routeObject))); err == nil {
+				registered = append(registered, n)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return VerdictUnknown, err
+	}
+
+	for _, prefix := range peer.Prefixes {
+		_, network, err := net.ParseCIDR(prefix)
+		if err != nil {
+			continue
+		}
+		netOnes, _ := network.Mask.Size()
+		covered := false
+		for _, r := range registered {
+			if rOnes, _ := r.Mask.Size(); r.Contains(network.IP) && netOnes >= rOnes {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return VerdictInvalidOrigin, nil
+		}
+	}
+	return VerdictValid, nil
+}
+
+// rpkiValidator resolves ROAs for a peer's origin ASN from a rpki-client(8)
+// JSON dump (see "rpki-client -j"), reloading it from disk whenever it
+// changes. A future iteration could talk directly to an RTR server instead.
+type rpkiValidator struct {
+	// JSONPath is the path to the rpki-client JSON output. Defaults to
+	// /var/lib/rpki-client/json if empty.
+	JSONPath string
+
+	mu      sync.Mutex
+	modTime time.Time
+	roas    []roaEntry
+}
+
+type roaEntry struct {
+	ASN       int
+	Prefix    *net.IPNet
+	MaxLength int
+}
+
+func (v *rpkiValidator) Name() string { return "rpki" }
+
+func (v *rpkiValidator) NextRun(last time.Time, failed bool) time.Time {
+	if failed {
+		return last.Add(2 * time.Minute)
+	}
+	return last.Add(10 * time.Minute)
+}
+
+func (v *rpkiValidator) jsonPath() string {
+	if v.JSONPath != "" {
+		return v.JSONPath
+	}
+	return "/var/lib/rpki-client/json"
+}
+
+// loadROAs (re)loads the ROA dump if it has changed on disk since the last
+// load.
+func (v *rpkiValidator) loadROAs() error {
+	path := v.jsonPath()
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.roas != nil && fi.ModTime().Equal(v.modTime) {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var dump struct {
+		ROAs []struct {
+			ASN       string `json:"asn"`
+			Prefix    string `json:"prefix"`
+			MaxLength int    `json:"maxLength"`
+		} `json:"roas"`
+	}
+	if err := json.NewDecoder(f).Decode(&dump); err != nil {
+		return err
+	}
+
+	roas := make([]roaEntry, 0, len(dump.ROAs))
+	for _, r := range dump.ROAs {
+		asn, err := strconv.Atoi(strings.TrimPrefix(r.ASN, "AS"))
+		if err != nil {
+			continue
+		}
+		_, prefix, err := net.ParseCIDR(r.Prefix)
+		if err != nil {
+			continue
+		}
+		maxLength := r.MaxLength
+		if maxLength == 0 {
+			// rpki-client omits maxLength when it equals the prefix length.
+			ones, _ := prefix.Mask.Size()
+			maxLength = ones
+		}
+		roas = append(roas, roaEntry{ASN: asn, Prefix: prefix, MaxLength: maxLength})
+	}
+
+	v.roas = roas
+	v.modTime = fi.ModTime()
+	return nil
+}
+
+func (v *rpkiValidator) Check(ctx context.Context, peer Peer) (Verdict, error) {
+	if peer.ASN == 0 {
+		return VerdictUnknown, nil
+	}
+	if err := v.loadROAs(); err != nil {
+		return VerdictUnknown, fmt.Errorf("unable to load ROA dump: %w", err)
+	}
+
+	v.mu.Lock()
+	roas := v.roas
+	v.mu.Unlock()
+
+	if len(roas) == 0 {
+		return VerdictNoROV, nil
+	}
+	if len(peer.Prefixes) == 0 {
+		return VerdictUnknown, nil
+	}
+
+	for _, prefix := range peer.Prefixes {
+		_, network, err := net.ParseCIDR(prefix)
+		if err != nil {
+			continue
+		}
+		if !roaCoversPrefix(roas, peer.ASN, network) {
+			return VerdictInvalidOrigin, nil
+		}
+	}
+	return VerdictValid, nil
+}
+
+// roaCoversPrefix reports whether network is covered by a ROA belonging to
+// asn: contained within the ROA's prefix and no more specific than its
+// max length, per RFC 6811 Route Origin Validation.
+func roaCoversPrefix(roas []roaEntry, asn int, network *net.IPNet) bool {
+	netOnes, _ := network.Mask.Size()
+	for _, roa := range roas {
+		if roa.ASN != asn || !roa.Prefix.Contains(network.IP) {
+			continue
+		}
+		roaOnes, _ := roa.Prefix.Mask.Size()
+		if netOnes >= roaOnes && netOnes <= roa.MaxLength {
+			return true
+		}
+	}
+	return false
+}
+
+// peeringDBValidator confirms a peer's declared prefix counts in PeeringDB
+// are consistent with what we actually observe from it.
+type peeringDBValidator struct {
+	apiBase string
+	client  *http.Client
+}
+
+func (v *peeringDBValidator) Name() string { return "peeringdb" }
+
+func (v *peeringDBValidator) NextRun(last time.Time, failed bool) time.Time {
+	if failed {
+		return last.Add(15 * time.Minute)
+	}
+	return last.Add(6 * time.Hour)
+}
+
+func (v *peeringDBValidator) httpClient() *http.Client {
+	if v.client != nil {
+		return v.client
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+func (v *peeringDBValidator) Check(ctx context.Context, peer Peer) (Verdict, error) {
+	if peer.ASN == 0 {
+		return VerdictUnknown, nil
+	}
+
+	url := fmt.Sprintf("%s/net?asn=%d", v.apiBase, peer.ASN)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return VerdictUnknown, err
+	}
+
+	resp, err := v.httpClient().Do(req)
+	if err != nil {
+		return VerdictUnknown, fmt.Errorf("unable to query PeeringDB: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Data []struct {
+			InfoPrefixes4 int `json:"info_prefixes4"`
+			InfoPrefixes6 int `json:"info_prefixes6"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return VerdictUnknown, fmt.Errorf("unable to decode PeeringDB response: %w", err)
+	}
+	if len(result.Data) == 0 {
+		return VerdictUnknown, nil
+	}
+
+	declared := result.Data[0].InfoPrefixes4
+	if strings.Contains(peer.PeerAddress, ":") {
+		declared = result.Data[0].InfoPrefixes6
+	}
+
+	if declared > 0 && peer.PrefixesReceived > declared {
+		return VerdictPrefixMismatch, nil
+	}
+	return VerdictValid, nil
+}
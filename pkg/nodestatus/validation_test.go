@@ -0,0 +1,214 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nodestatus
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("invalid CIDR %q: %v", s, err)
+	}
+	return n
+}
+
+func TestRoaCoversPrefix(t *testing.T) {
+	roas := []roaEntry{
+		{ASN: 64512, Prefix: mustCIDR(t, "10.0.0.0/16"), MaxLength: 24},
+		{ASN: 64513, Prefix: mustCIDR(t, "10.1.0.0/16"), MaxLength: 16},
+	}
+
+	tests := []struct {
+		name    string
+		asn     int
+		network string
+		want    bool
+	}{
+		{"exact match", 64512, "10.0.0.0/16", true},
+		{"more specific within max length", 64512, "10.0.5.0/24", true},
+		{"more specific beyond max length", 64512, "10.0.5.0/28", false},
+		{"wrong ASN for the covering ROA", 64513, "10.0.0.0/16", false},
+		{"not covered by any ROA", 64512, "192.168.0.0/24", false},
+		{"exact-length-only ROA", 64513, "10.1.0.0/16", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network := mustCIDR(t, tt.network)
+			if got := roaCoversPrefix(roas, tt.asn, network); got != tt.want {
+				t.Errorf("roaCoversPrefix(%d, %s) = %v, want %v", tt.asn, tt.network, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRPKIValidatorCheck(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rpki.json")
+	if err := os.WriteFile(path, []byte(`{"roas":[{"asn":"AS64512","prefix":"10.0.0.0/16","maxLength":24}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	v := &rpkiValidator{JSONPath: path}
+
+	tests := []struct {
+		name     string
+		peer     Peer
+		wantVerd Verdict
+	}{
+		{"no ASN", Peer{}, VerdictUnknown},
+		{"no advertised prefixes known", Peer{ASN: 64512}, VerdictUnknown},
+		{"covered prefix", Peer{ASN: 64512, Prefixes: []string{"10.0.5.0/24"}}, VerdictValid},
+		{"uncovered prefix", Peer{ASN: 64512, Prefixes: []string{"192.168.0.0/24"}}, VerdictInvalidOrigin},
+		{"wrong origin ASN", Peer{ASN: 64513, Prefixes: []string{"10.0.5.0/24"}}, VerdictInvalidOrigin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := v.Check(context.Background(), tt.peer)
+			if err != nil {
+				t.Fatalf("Check returned error: %v", err)
+			}
+			if got != tt.wantVerd {
+				t.Errorf("Check() = %s, want %s", got, tt.wantVerd)
+			}
+		})
+	}
+}
+
+// serveWhoisOnce starts a single-shot TCP server that replies with response
+// to the first connection it accepts, emulating a whois server.
+func serveWhoisOnce(t *testing.T, response string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufio.NewReader(conn).ReadString('\n') // drain the query line
+		conn.Write([]byte(response))
+	}()
+	return ln.Addr().String()
+}
+
+func TestIRRValidatorCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		peer     Peer
+		wantVerd Verdict
+	}{
+		{
+			name:     "registered route object covers the announced prefix",
+			response: "route:          10.0.0.0/24\norigin:         AS64512\n",
+			peer:     Peer{ASN: 64512, Prefixes: []string{"10.0.0.0/24"}},
+			wantVerd: VerdictValid,
+		},
+		{
+			name:     "announced prefix has no matching route object",
+			response: "route:          10.0.0.0/24\norigin:         AS64512\n",
+			peer:     Peer{ASN: 64512, Prefixes: []string{"10.1.0.0/24"}},
+			wantVerd: VerdictInvalidOrigin,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := serveWhoisOnce(t, tt.response)
+			v := &irrValidator{whoisAddr: addr}
+			got, err := v.Check(context.Background(), tt.peer)
+			if err != nil {
+				t.Fatalf("Check returned error: %v", err)
+			}
+			if got != tt.wantVerd {
+				t.Errorf("Check() = %s, want %s", got, tt.wantVerd)
+			}
+		})
+	}
+}
+
+func TestIRRValidatorCheckNoPrefixesKnown(t *testing.T) {
+	v := &irrValidator{whoisAddr: "127.0.0.1:0"}
+	got, err := v.Check(context.Background(), Peer{ASN: 64512})
+	if err != nil {
+		t.Fatalf("Check returned error: %v", err)
+	}
+	if got != VerdictUnknown {
+		t.Errorf("Check() = %s, want %s", got, VerdictUnknown)
+	}
+}
+
+func TestPeeringDBValidatorCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":[{"info_prefixes4":10,"info_prefixes6":0}]}`))
+	}))
+	defer srv.Close()
+
+	v := &peeringDBValidator{apiBase: srv.URL}
+
+	tests := []struct {
+		name     string
+		received int
+		wantVerd Verdict
+	}{
+		{"within declared count", 5, VerdictValid},
+		{"exceeds declared count", 20, VerdictPrefixMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := Peer{ASN: 64512, PeerAddress: "172.17.8.1", PrefixesReceived: tt.received}
+			got, err := v.Check(context.Background(), peer)
+			if err != nil {
+				t.Fatalf("Check returned error: %v", err)
+			}
+			if got != tt.wantVerd {
+				t.Errorf("Check() = %s, want %s", got, tt.wantVerd)
+			}
+		})
+	}
+}
+
+func TestCombinedVerdictPrefixMismatchDoesNotMaskAsInvalidOrigin(t *testing.T) {
+	vm := newValidationManager()
+	vm.results["172.17.8.1"] = map[string]ValidationResult{
+		"rpki":      {Verdict: VerdictValid},
+		"irr":       {Verdict: VerdictValid},
+		"peeringdb": {Verdict: VerdictPrefixMismatch},
+	}
+	if got := vm.CombinedVerdict("172.17.8.1"); got != VerdictPrefixMismatch {
+		t.Errorf("CombinedVerdict() = %s, want %s", got, VerdictPrefixMismatch)
+	}
+
+	vm.results["172.17.8.2"] = map[string]ValidationResult{
+		"rpki": {Verdict: VerdictInvalidOrigin},
+	}
+	if got := vm.CombinedVerdict("172.17.8.2"); got != VerdictInvalidOrigin {
+		t.Errorf("CombinedVerdict() = %s, want %s", got, VerdictInvalidOrigin)
+	}
+}